@@ -1,16 +1,46 @@
 package registry
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/docker/distribution"
 	digest "github.com/opencontainers/go-digest"
 )
 
+// defaultStreamingChunkSize is the chunk size UploadBlobStreaming PATCHes
+// while it doesn't yet know the final digest or size of content.
+const defaultStreamingChunkSize = 4 * 1024 * 1024
+
 func (registry *Registry) DownloadBlob(repository string, digest digest.Digest) (io.ReadCloser, error) {
+	body, err := registry.downloadBlobRaw(repository, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if registry.SkipDigestVerification {
+		return body, nil
+	}
+	return newVerifyingReadCloser(body, digest), nil
+}
+
+// downloadBlobRaw performs the GET behind DownloadBlob but never wraps the
+// body in the verifying reader. It backs blobReaderAt's no-Accept-Ranges
+// fallback, which only ever reads a partial prefix of the body before
+// closing it — running that through verifyingReadCloser would report a
+// spurious DigestMismatchError for every such read (since the full-blob
+// digest can never match a partial read) and pay for hashing the discarded
+// prefix besides.
+func (registry *Registry) downloadBlobRaw(repository string, digest digest.Digest) (io.ReadCloser, error) {
 	url := registry.url("/v2/%s/blobs/%s", repository, digest)
 	registry.Logf("registry.blob.download url=%s repository=%s digest=%s", url, repository, digest)
 
@@ -18,10 +48,179 @@ func (registry *Registry) DownloadBlob(repository string, digest digest.Digest)
 	if err != nil {
 		return nil, err
 	}
+	return resp.Body, nil
+}
+
+// DigestMismatchError is returned by the verifying reader DownloadBlob
+// wraps its response body in, once the body has been read to EOF or closed
+// and the bytes read so far don't hash to the digest that was requested.
+// Without this check a MITM or a corrupt storage backend could serve the
+// wrong bytes silently.
+type DigestMismatchError struct {
+	Expected  digest.Digest
+	Actual    digest.Digest
+	BytesRead int64
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("registry: digest mismatch after reading %d bytes: expected %s, got %s", e.BytesRead, e.Expected, e.Actual)
+}
+
+// verifyingReadCloser hashes bytes as they are read from rc and compares the
+// result against expected once rc reports EOF (from Read) or is Close'd,
+// whichever happens first. Once the mismatch has been observed it is
+// returned from every subsequent Read and from Close.
+type verifyingReadCloser struct {
+	rc        io.ReadCloser
+	expected  digest.Digest
+	hasher    hash.Hash
+	bytesRead int64
+	checked   bool
+	err       error
+}
+
+func newVerifyingReadCloser(rc io.ReadCloser, expected digest.Digest) io.ReadCloser {
+	return &verifyingReadCloser{rc: rc, expected: expected, hasher: expected.Algorithm().Hash()}
+}
+
+func (v *verifyingReadCloser) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.rc.Read(p)
+	if n > 0 {
+		v.hasher.Write(p[:n])
+		v.bytesRead += int64(n)
+	}
+	if err == io.EOF {
+		if verifyErr := v.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReadCloser) Close() error {
+	closeErr := v.rc.Close()
+	if verifyErr := v.verify(); verifyErr != nil {
+		return verifyErr
+	}
+	return closeErr
+}
+
+func (v *verifyingReadCloser) verify() error {
+	if v.checked {
+		return v.err
+	}
+	v.checked = true
+	actual := digest.NewDigest(v.expected.Algorithm(), v.hasher)
+	if actual != v.expected {
+		v.err = &DigestMismatchError{Expected: v.expected, Actual: actual, BytesRead: v.bytesRead}
+	}
+	return v.err
+}
+
+// DownloadBlobRange downloads length bytes of repository's digest blob
+// starting at offset, via a Range request. The registry must respond with
+// 206 Partial Content; any other status is treated as an error.
+func (registry *Registry) DownloadBlobRange(repository string, digest digest.Digest, offset, length int64) (io.ReadCloser, error) {
+	blobUrl := registry.url("/v2/%s/blobs/%s", repository, digest)
+	registry.Logf("registry.blob.download-range url=%s repository=%s digest=%s offset=%d length=%d", blobUrl, repository, digest, offset, length)
+
+	req, err := http.NewRequest("GET", blobUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
 
+	resp, err := registry.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response to ranged download of %s, digest: %s: %v %v", repository, digest, resp.StatusCode, resp.Status)
+	}
 	return resp.Body, nil
 }
 
+// blobReaderAt implements io.ReaderAt over a remote blob by issuing a
+// ranged GET per ReadAt call. Registries that don't advertise
+// Accept-Ranges: bytes fall back to a full GET with the unwanted prefix
+// discarded client-side.
+type blobReaderAt struct {
+	registry     *Registry
+	repository   string
+	digest       digest.Digest
+	acceptRanges bool
+}
+
+func (r *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if r.acceptRanges {
+		body, err := r.registry.DownloadBlobRange(r.repository, r.digest, off, int64(len(p)))
+		if err != nil {
+			return 0, err
+		}
+		defer body.Close()
+		n, err := io.ReadFull(body, p)
+		return n, asEOF(err)
+	}
+
+	// Use the unverified GET, not DownloadBlob: only a prefix of the body
+	// is read below, and checking that prefix against the full blob's
+	// digest would always fail.
+	body, err := r.registry.downloadBlobRaw(r.repository, r.digest)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	if _, err := io.CopyN(ioutil.Discard, body, off); err != nil {
+		return 0, asEOF(err)
+	}
+	n, err := io.ReadFull(body, p)
+	return n, asEOF(err)
+}
+
+// asEOF normalizes io.ErrUnexpectedEOF (returned by io.ReadFull when the
+// source is exhausted after some but not all of the requested bytes; io.CopyN
+// already reports io.EOF in that case and passes through unchanged) to io.EOF,
+// matching the io.ReaderAt contract that bytes.Reader/strings.Reader
+// already follow: a short read because the source is exhausted reports
+// io.EOF, not io.ErrUnexpectedEOF, so callers can keep using the idiomatic
+// `if err != nil && err != io.EOF` check.
+func asEOF(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+// BlobReaderAt returns an io.ReaderAt over repository's digest blob along
+// with its total size, so callers can random-access a layer (e.g. read a
+// single file out of a tar without pulling the whole layer, or resume an
+// interrupted pull) instead of streaming it sequentially. It HEADs the blob
+// to learn both its size and whether the registry advertises
+// Accept-Ranges: bytes; when it doesn't, the returned ReaderAt falls back to
+// a full GET per ReadAt call with client-side discard of the unwanted
+// prefix.
+func (registry *Registry) BlobReaderAt(repository string, digest digest.Digest) (io.ReaderAt, int64, error) {
+	checkUrl := registry.url("/v2/%s/blobs/%s", repository, digest)
+	resp, err := registry.Client.Head(checkUrl)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &blobReaderAt{
+		registry:     registry,
+		repository:   repository,
+		digest:       digest,
+		acceptRanges: resp.Header.Get("Accept-Ranges") == "bytes",
+	}, resp.ContentLength, nil
+}
+
 // Sending Monolithic chunked upload - following docker API specification for Chunked uploads : https://docs.docker.com/registry/spec/api/#listing-repositories
 // See UploadBlob for more info about getBody
 func (registry *Registry) UploadBlobToArtifactory(repository string, digest digest.Digest, content io.Reader, getBody func() (io.ReadCloser, error)) error {
@@ -74,6 +273,429 @@ func (registry *Registry) UploadBlobToArtifactory(repository string, digest dige
 	return err
 }
 
+// ChunkedUploadOption configures the behaviour of UploadBlobChunked.
+type ChunkedUploadOption func(*chunkedUploadConfig)
+
+type chunkedUploadConfig struct {
+	getBody func() (io.ReadCloser, error)
+}
+
+// WithChunkedGetBody supplies a function returning a fresh reader positioned
+// at the start of content, mirroring the getBody parameter of UploadBlob.
+// When it is set and a PATCH fails, UploadBlobChunked discards the fresh
+// reader up to the end of the chunk being retried and reads all further
+// chunks from it instead of from content. Without it, the retry still
+// happens and later chunks keep being read from content.
+func WithChunkedGetBody(getBody func() (io.ReadCloser, error)) ChunkedUploadOption {
+	return func(c *chunkedUploadConfig) { c.getBody = getBody }
+}
+
+// UploadBlobChunked uploads an FS layer or image config file using the
+// chunked flavour of the distribution spec, as opposed to the single-PATCH
+// approach in UploadBlobToArtifactory or the single-PUT approach in
+// UploadBlob: content is PATCHed in chunkSize pieces, each chunk's Location
+// and Range response headers are honored as the next upload URL/offset, and
+// the upload is finalized with a PUT carrying ?digest=. On a 5xx or network
+// error mid-upload, it HEADs the upload UUID to learn the byte offset the
+// registry actually committed, re-sends the uncommitted rest of the chunk
+// from its in-memory buffer starting at that offset, and, when
+// WithChunkedGetBody is given, continues reading from a fresh copy of content
+// discarded past that chunk — this is the retry that
+// UploadBlobToArtifactory's TODO describes but never implements.
+func (registry *Registry) UploadBlobChunked(repository string, digest digest.Digest, content io.Reader, chunkSize int64, opts ...ChunkedUploadOption) error {
+	var cfg chunkedUploadConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if chunkSize <= 0 {
+		return fmt.Errorf("registry: chunkSize must be positive, got %d", chunkSize)
+	}
+
+	uploadUrl, err := registry.initiateUpload(repository)
+	if err != nil {
+		return err
+	}
+	registry.Logf("registry.blob.upload-chunked url=%s repository=%s digest=%s chunkSize=%d", uploadUrl, repository, digest, chunkSize)
+
+	var offset int64
+	buf := make([]byte, chunkSize)
+	for {
+		n, readErr := io.ReadFull(content, buf)
+		if readErr != nil && readErr != io.ErrUnexpectedEOF && readErr != io.EOF {
+			return fmt.Errorf("error while reading blob for %s, digest: %s: %s", repository, digest, readErr)
+		}
+		done := readErr == io.EOF || readErr == io.ErrUnexpectedEOF
+
+		if n > 0 {
+			nextUrl, acked, patchErr := registry.patchUpload(uploadUrl, buf[:n], offset)
+			if patchErr != nil {
+				nextUrl, acked, content, patchErr = registry.resumeChunkedUpload(uploadUrl, buf[:n], offset, content, cfg.getBody)
+				if patchErr != nil {
+					return fmt.Errorf("error while uploading blob to %s, digest: %s: %s", repository, digest, patchErr)
+				}
+			}
+			uploadUrl, offset = nextUrl, acked
+		}
+
+		if done {
+			break
+		}
+	}
+
+	return registry.finalizeChunkedUpload(repository, digest, uploadUrl)
+}
+
+// resumeChunkedUpload is invoked after a PATCH failure. It HEADs the upload
+// UUID for the authoritative Range, then re-sends whatever portion of chunk
+// the server hasn't committed. If getBody is set, it also swaps in a fresh
+// copy of the source reader discarded up to the end of chunk, so subsequent
+// chunks keep reading from the right place even though the original reader
+// may be in an unknown state (e.g. after a connection reset).
+func (registry *Registry) resumeChunkedUpload(uploadUrl *url.URL, chunk []byte, start int64, content io.Reader, getBody func() (io.ReadCloser, error)) (*url.URL, int64, io.Reader, error) {
+	acked, err := registry.resumeOffset(uploadUrl)
+	if err != nil {
+		return nil, 0, content, err
+	}
+	if acked < start {
+		// The distribution spec guarantees acknowledged offsets only move
+		// forward; a regression means the registry's upload state and our
+		// own view of it have diverged in a way we can't safely resume
+		// from (chunk[acked-start:] would index with a negative offset).
+		return nil, 0, content, &UploadOffsetMismatchError{Expected: start, Acked: acked}
+	}
+	if acked >= start+int64(len(chunk)) {
+		// The registry already has the whole chunk despite the error.
+		return uploadUrl, acked, content, nil
+	}
+
+	if getBody != nil {
+		fresh, err := getBody()
+		if err != nil {
+			return nil, 0, content, err
+		}
+		// The remainder of chunk (from acked to its end) is resent below
+		// from the in-memory buffer, not re-read from fresh. So fresh must
+		// be discarded all the way to the end of this chunk, not just to
+		// acked, or the next loop iteration's read from content would
+		// re-read already-buffered bytes and send them under the wrong
+		// Content-Range.
+		if _, err := io.CopyN(ioutil.Discard, fresh, start+int64(len(chunk))); err != nil {
+			return nil, 0, content, err
+		}
+		content = fresh
+	}
+
+	nextUrl, newAcked, err := registry.patchUpload(uploadUrl, chunk[acked-start:], acked)
+	return nextUrl, newAcked, content, err
+}
+
+// UploadOffsetMismatchError is returned when a registry acknowledges a
+// chunk at an offset other than the one the client expected — either a HEAD
+// against an in-progress upload's UUID reporting an offset behind the
+// chunk being retried, or (in UploadBlobParallel) a PATCH response Range
+// that doesn't land on the chunk's precomputed boundary. Per the
+// distribution spec, acknowledged offsets only move forward in lockstep
+// with what was sent, so either case means the registry's view of the
+// upload and the client's have diverged in a way that isn't safe to
+// resume from.
+type UploadOffsetMismatchError struct {
+	Expected int64
+	Acked    int64
+}
+
+func (e *UploadOffsetMismatchError) Error() string {
+	return fmt.Sprintf("registry: acknowledged upload offset %d does not match expected offset %d", e.Acked, e.Expected)
+}
+
+// patchUpload PATCHes a single chunk starting at byte offset start and
+// returns the next upload URL (from Location) and the offset the registry
+// has acknowledged (from Range).
+func (registry *Registry) patchUpload(uploadUrl *url.URL, chunk []byte, start int64) (*url.URL, int64, error) {
+	end := start + int64(len(chunk)) - 1
+	req, err := http.NewRequest("PATCH", uploadUrl.String(), bytes.NewReader(chunk))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Length", strconv.Itoa(len(chunk)))
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, end))
+
+	resp, err := registry.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, 0, fmt.Errorf("unexpected PATCH response during chunked upload: %v %v", resp.StatusCode, resp.Status)
+	}
+
+	nextUrl, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, 0, err
+	}
+	acked, err := parseRangeEnd(resp.Header.Get("Range"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return nextUrl, acked, nil
+}
+
+// resumeOffset HEADs the upload UUID and returns the authoritative byte
+// offset the registry has committed so far, read from the Range header.
+func (registry *Registry) resumeOffset(uploadUrl *url.URL) (int64, error) {
+	resp, err := registry.Client.Head(uploadUrl.String())
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return parseRangeEnd(resp.Header.Get("Range"))
+}
+
+// finalizeChunkedUpload completes a chunked upload with a PUT carrying
+// ?digest= and no body, per the distribution spec.
+func (registry *Registry) finalizeChunkedUpload(repository string, digest digest.Digest, uploadUrl *url.URL) error {
+	q := uploadUrl.Query()
+	q.Set("digest", digest.String())
+	uploadUrl.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("PUT", uploadUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := registry.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("error while finalizing chunked upload to %s, digest: %s: %s", repository, digest, err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected PUT response while finalizing chunked upload to %s: %v %v: digest: %s", repository, resp.StatusCode, resp.Status, digest)
+	}
+	return nil
+}
+
+// parseRangeEnd parses the Range response header sent by upload endpoints
+// (e.g. "0-1023") and returns the offset of the first unwritten byte. Some
+// registries omit the header on a HEAD of an upload UUID that hasn't
+// acknowledged any bytes yet, which is treated as offset 0 rather than an
+// error.
+func parseRangeEnd(rangeHeader string) (int64, error) {
+	if rangeHeader == "" {
+		return 0, nil
+	}
+	parts := strings.SplitN(rangeHeader, "-", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("registry: malformed Range header %q", rangeHeader)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("registry: malformed Range header %q: %s", rangeHeader, err)
+	}
+	return end + 1, nil
+}
+
+// patchChunkWithRetry PATCHes a single chunk of a parallel upload, retrying
+// once via the same HEAD-based resume UploadBlobChunked uses if the first
+// attempt fails with a 5xx/network error. Without this, a single worker's
+// transient failure would otherwise abort the entire multi-GB upload, since
+// UploadBlobParallel has no way to re-run just one worker after the fact.
+func (registry *Registry) patchChunkWithRetry(uploadUrl *url.URL, chunk []byte, start int64) (*url.URL, int64, error) {
+	nextUrl, acked, err := registry.patchUpload(uploadUrl, chunk, start)
+	if err == nil {
+		return nextUrl, acked, nil
+	}
+
+	nextUrl, acked, _, err = registry.resumeChunkedUpload(uploadUrl, chunk, start, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return nextUrl, acked, nil
+}
+
+// chunkBound is one [start, end) byte range of a blob being split for
+// UploadBlobParallel.
+type chunkBound struct {
+	start, end int64
+}
+
+// chunkBounds splits [0, size) into at most n contiguous chunks of roughly
+// equal size, folding any remainder from integer division into the last
+// chunk so callers never get more than n chunks back.
+func chunkBounds(size int64, n int) []chunkBound {
+	if n < 1 {
+		n = 1
+	}
+	if size <= 0 {
+		return nil
+	}
+	chunkSize := size / int64(n)
+	if chunkSize == 0 {
+		chunkSize = 1
+	}
+
+	var bounds []chunkBound
+	for start := int64(0); start < size; start += chunkSize {
+		end := start + chunkSize
+		if end > size {
+			end = size
+		}
+		bounds = append(bounds, chunkBound{start, end})
+	}
+	if len(bounds) > n {
+		bounds[n-1].end = bounds[len(bounds)-1].end
+		bounds = bounds[:n]
+	}
+	return bounds
+}
+
+// UploadBlobParallel uploads the size bytes of content into repository
+// under digest by splitting [0, size) into at most parallelism contiguous
+// chunks (see chunkBounds) and PATCHing them with a worker pool. The distribution spec requires
+// each chunk's Content-Range to start exactly where the registry last
+// acknowledged, so while every worker reads its own chunk from content
+// concurrently, a per-upload sequencer of channels only lets a worker send
+// its PATCH once the previous chunk has been acknowledged and handed it
+// the resulting upload URL. Finalizes with a single PUT carrying ?digest=.
+func (registry *Registry) UploadBlobParallel(repository string, digest digest.Digest, content io.ReaderAt, size int64, parallelism int) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	uploadUrl, err := registry.initiateUpload(repository)
+	if err != nil {
+		return err
+	}
+	registry.Logf("registry.blob.upload-parallel url=%s repository=%s digest=%s size=%d parallelism=%d", uploadUrl, repository, digest, size, parallelism)
+
+	bounds := chunkBounds(size, parallelism)
+
+	// turn[i] yields the upload URL a worker may PATCH against once it's
+	// their turn; turn[i] sends to turn[i+1] after a successful PATCH, or a
+	// nil URL if the upload has been aborted.
+	turn := make([]chan *url.URL, len(bounds)+1)
+	for i := range turn {
+		turn[i] = make(chan *url.URL, 1)
+	}
+	turn[0] <- uploadUrl
+
+	errs := make([]error, len(bounds))
+	var wg sync.WaitGroup
+	for i, b := range bounds {
+		wg.Add(1)
+		go func(i int, b chunkBound) {
+			defer wg.Done()
+
+			buf := make([]byte, b.end-b.start)
+			n, err := content.ReadAt(buf, b.start)
+			if err != nil && err != io.EOF {
+				errs[i] = fmt.Errorf("error while reading blob for %s, digest: %s: %s", repository, digest, err)
+				turn[i+1] <- nil
+				return
+			}
+			if n != len(buf) {
+				// io.ReaderAt permits a short read to be reported as
+				// (n < len(buf), io.EOF); treat that the same as any other
+				// read error instead of silently PATCHing the zero-filled
+				// tail of buf, which would happen if size overstates the
+				// real length of content.
+				errs[i] = fmt.Errorf("error while reading blob for %s, digest: %s: short read at offset %d: got %d bytes, want %d", repository, digest, b.start, n, len(buf))
+				turn[i+1] <- nil
+				return
+			}
+
+			currentUrl := <-turn[i]
+			if currentUrl == nil {
+				turn[i+1] <- nil
+				return
+			}
+
+			nextUrl, acked, err := registry.patchChunkWithRetry(currentUrl, buf, b.start)
+			if err != nil {
+				errs[i] = fmt.Errorf("error while uploading blob to %s, digest: %s: %s", repository, digest, err)
+				turn[i+1] <- nil
+				return
+			}
+			if acked != b.end {
+				// The registry's acknowledged offset is the only thing the
+				// next worker's PATCH may trust as its Content-Range start;
+				// since chunk boundaries were fixed up front, anything
+				// other than b.end here means our view of the upload has
+				// diverged from the registry's and it's not safe to let
+				// the next worker proceed with its precomputed chunk.
+				errs[i] = fmt.Errorf("error while uploading blob to %s, digest: %s: %s", repository, digest, &UploadOffsetMismatchError{Expected: b.end, Acked: acked})
+				turn[i+1] <- nil
+				return
+			}
+			turn[i+1] <- nextUrl
+		}(i, b)
+	}
+	wg.Wait()
+
+	finalUrl := <-turn[len(bounds)]
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	if finalUrl == nil {
+		return fmt.Errorf("error while uploading blob to %s, digest: %s: upload aborted", repository, digest)
+	}
+
+	return registry.finalizeChunkedUpload(repository, digest, finalUrl)
+}
+
+// UploadBlobStreaming uploads content into repository when the caller does
+// not know its digest up front (e.g. a tar-stream producer). It initiates
+// an upload, PATCHes the content in fixed-size chunks while tee'ing the
+// bytes through a sha256 hash and counting the total size, then finalizes
+// with a PUT carrying the computed digest. It returns that digest and the
+// total size so callers can build a distribution.Descriptor and reference
+// it in a manifest without buffering the whole blob to disk first.
+func (registry *Registry) UploadBlobStreaming(repository string, content io.Reader) (digest.Digest, int64, error) {
+	uploadUrl, err := registry.initiateUpload(repository)
+	if err != nil {
+		return "", 0, err
+	}
+	registry.Logf("registry.blob.upload-streaming url=%s repository=%s", uploadUrl, repository)
+
+	hasher := sha256.New()
+	tee := io.TeeReader(content, hasher)
+
+	var offset, size int64
+	buf := make([]byte, defaultStreamingChunkSize)
+	for {
+		n, readErr := io.ReadFull(tee, buf)
+		if readErr != nil && readErr != io.ErrUnexpectedEOF && readErr != io.EOF {
+			return "", 0, fmt.Errorf("error while reading blob for %s: %s", repository, readErr)
+		}
+		done := readErr == io.EOF || readErr == io.ErrUnexpectedEOF
+
+		if n > 0 {
+			nextUrl, acked, patchErr := registry.patchUpload(uploadUrl, buf[:n], offset)
+			if patchErr != nil {
+				return "", 0, fmt.Errorf("error while uploading blob to %s: %s", repository, patchErr)
+			}
+			uploadUrl, offset = nextUrl, acked
+			size += int64(n)
+		}
+
+		if done {
+			break
+		}
+	}
+
+	computed := digest.NewDigest(digest.SHA256, hasher)
+	if err := registry.finalizeChunkedUpload(repository, computed, uploadUrl); err != nil {
+		return "", 0, err
+	}
+	return computed, size, nil
+}
+
 // UploadBlob can be used to upload an FS layer or an image config file into the given repository.
 // It uploads the bytes read from content. Digest must match with the hash of those bytes.
 // In case of token authentication the HTTP request must be retried after a 401 Unauthorized response
@@ -87,12 +709,23 @@ func (registry *Registry) UploadBlob(repository string, digest digest.Digest, co
 	if err != nil {
 		return err
 	}
+
+	registry.Logf("registry.blob.upload url=%s repository=%s digest=%s", uploadUrl, repository, digest)
+
+	return registry.uploadToUrl(uploadUrl, digest, content, getBody)
+}
+
+// uploadToUrl finishes a monolithic upload that has already been initiated
+// (or mounted) at uploadUrl by PUTting content with ?digest= appended. It is
+// shared by UploadBlob and by PushImage, which calls it with the upload URL
+// MountBlob returns when a mount is declined, so that a mount attempt which
+// falls back to a normal upload does not need to initiate a second upload
+// session.
+func (registry *Registry) uploadToUrl(uploadUrl *url.URL, digest digest.Digest, content io.Reader, getBody func() (io.ReadCloser, error)) error {
 	q := uploadUrl.Query()
 	q.Set("digest", digest.String())
 	uploadUrl.RawQuery = q.Encode()
 
-	registry.Logf("registry.blob.upload url=%s repository=%s digest=%s", uploadUrl, repository, digest)
-
 	upload, err := http.NewRequest("PUT", uploadUrl.String(), content)
 	if err != nil {
 		return err
@@ -110,6 +743,51 @@ func (registry *Registry) UploadBlob(repository string, digest digest.Digest, co
 	return nil
 }
 
+// MountBlob attempts to cross-mount a blob that already exists in srcRepo
+// into destRepo without re-uploading it, per the distribution spec's
+// mount-from optimization: POST /v2/<destRepo>/blobs/uploads/?mount=<digest>&from=<srcRepo>.
+// On 201 Created the mount succeeded and mounted is true. On 202 Accepted
+// the registry declined the mount (e.g. srcRepo doesn't have the blob, or
+// the registry doesn't support cross-repository mounting) and started a
+// normal upload instead; MountBlob then returns mounted=false along with
+// the upload URL from Location, so the caller can finish the upload with
+// the blob's content, e.g. by passing uploadUrl to uploadToUrl or just
+// calling UploadBlob again (which pays for a second initiate, but is simpler
+// when the mount is expected to usually succeed).
+func (registry *Registry) MountBlob(destRepo, srcRepo string, digest digest.Digest) (mounted bool, uploadUrl *url.URL, err error) {
+	mountUrl, err := url.Parse(registry.url("/v2/%s/blobs/uploads/", destRepo))
+	if err != nil {
+		return false, nil, err
+	}
+	q := mountUrl.Query()
+	q.Set("mount", digest.String())
+	q.Set("from", srcRepo)
+	mountUrl.RawQuery = q.Encode()
+
+	registry.Logf("registry.blob.mount url=%s destRepo=%s srcRepo=%s digest=%s", mountUrl, destRepo, srcRepo, digest)
+
+	resp, err := registry.Client.Post(mountUrl.String(), "application/octet-stream", nil)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil, nil
+	case http.StatusAccepted:
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return false, nil, err
+		}
+		return false, location, nil
+	default:
+		return false, nil, fmt.Errorf("unexpected response while mounting blob %s from %s into %s: %v %v", digest, srcRepo, destRepo, resp.StatusCode, resp.Status)
+	}
+}
+
 func (registry *Registry) HasBlob(repository string, digest digest.Digest) (bool, error) {
 	checkUrl := registry.url("/v2/%s/blobs/%s", repository, digest)
 	registry.Logf("registry.blob.check url=%s repository=%s digest=%s", checkUrl, repository, digest)
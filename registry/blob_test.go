@@ -0,0 +1,213 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestParseRangeEnd(t *testing.T) {
+	cases := []struct {
+		header  string
+		want    int64
+		wantErr bool
+	}{
+		{header: "0-1023", want: 1024},
+		{header: "1024-2047", want: 2048},
+		{header: "", want: 0},
+		{header: "bogus", wantErr: true},
+		{header: "0-bogus", wantErr: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseRangeEnd(c.header)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseRangeEnd(%q): expected an error, got none", c.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRangeEnd(%q): unexpected error: %s", c.header, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseRangeEnd(%q) = %d, want %d", c.header, got, c.want)
+		}
+	}
+}
+
+func TestChunkBounds(t *testing.T) {
+	cases := []struct {
+		name string
+		size int64
+		n    int
+		want []chunkBound
+	}{
+		{name: "even split", size: 10, n: 2, want: []chunkBound{{0, 5}, {5, 10}}},
+		{name: "remainder folds into last chunk", size: 10, n: 3, want: []chunkBound{{0, 3}, {3, 6}, {6, 10}}},
+		{name: "more workers than bytes", size: 2, n: 5, want: []chunkBound{{0, 1}, {1, 2}}},
+		{name: "zero size", size: 0, n: 4, want: nil},
+		{name: "n below one treated as one", size: 10, n: 0, want: []chunkBound{{0, 10}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := chunkBounds(c.size, c.n)
+			if len(got) != len(c.want) {
+				t.Fatalf("chunkBounds(%d, %d) = %v, want %v", c.size, c.n, got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("chunkBounds(%d, %d)[%d] = %v, want %v", c.size, c.n, i, got[i], c.want[i])
+				}
+			}
+
+			var total int64
+			for _, b := range got {
+				total += b.end - b.start
+			}
+			if total != c.size {
+				t.Errorf("chunkBounds(%d, %d) covers %d bytes, want %d", c.size, c.n, total, c.size)
+			}
+		})
+	}
+}
+
+// TestUploadBlobChunkedResumesAfterPartialAck drives UploadBlobChunked
+// against a real HTTP test double that fails the first chunk's PATCH after
+// having committed only part of it, to make sure the retry resumes the
+// WithChunkedGetBody reader from the right offset: the end of the chunk
+// being retried, not the registry's partial-ack offset. Getting this wrong
+// either re-sends already-buffered bytes under the wrong Content-Range or
+// skips bytes entirely (see the chunk0-1 fix this guards).
+func TestUploadBlobChunkedResumesAfterPartialAck(t *testing.T) {
+	const chunkSize = 100
+	content := make([]byte, 150)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	var (
+		mu             sync.Mutex
+		patchCalls     int
+		committed      int64
+		firstChunkBody []byte
+	)
+	uploadPath := "/v2/test-repo/blobs/uploads/upload-1"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/test-repo/blobs/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %s on initiate path", r.Method)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", "http://"+r.Host+uploadPath)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc(uploadPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("Range", fmt.Sprintf("0-%d", committed-1))
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodPatch:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("reading PATCH body: %s", err)
+			}
+			mu.Lock()
+			patchCalls++
+			call := patchCalls
+			mu.Unlock()
+
+			switch call {
+			case 1:
+				// The first attempt at the first chunk: pretend the
+				// registry committed only the first 60 of its 100 bytes
+				// before the request failed.
+				if len(body) != chunkSize {
+					t.Errorf("PATCH #1: got %d bytes, want %d", len(body), chunkSize)
+				}
+				firstChunkBody = append([]byte(nil), body...)
+				mu.Lock()
+				committed = 60
+				mu.Unlock()
+				w.WriteHeader(http.StatusInternalServerError)
+
+			case 2:
+				// The retry of the first chunk's unacknowledged tail.
+				if got, want := r.Header.Get("Content-Range"), "60-99"; got != want {
+					t.Errorf("PATCH #2 Content-Range = %q, want %q", got, want)
+				}
+				if want := firstChunkBody[60:]; !bytes.Equal(body, want) {
+					t.Errorf("PATCH #2 body = %v, want %v", body, want)
+				}
+				mu.Lock()
+				committed = 100
+				mu.Unlock()
+				w.Header().Set("Location", "http://"+r.Host+uploadPath)
+				w.Header().Set("Range", "0-99")
+				w.WriteHeader(http.StatusAccepted)
+
+			case 3:
+				// The second chunk must start exactly where the first
+				// left off: no bytes re-sent, none skipped.
+				if got, want := r.Header.Get("Content-Range"), "100-149"; got != want {
+					t.Errorf("PATCH #3 Content-Range = %q, want %q", got, want)
+				}
+				if want := content[100:150]; !bytes.Equal(body, want) {
+					t.Errorf("PATCH #3 body = %v, want %v", body, want)
+				}
+				mu.Lock()
+				committed = 150
+				mu.Unlock()
+				w.Header().Set("Location", "http://"+r.Host+uploadPath)
+				w.Header().Set("Range", "0-149")
+				w.WriteHeader(http.StatusAccepted)
+
+			default:
+				t.Errorf("unexpected PATCH #%d", call)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+
+		case http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+
+		default:
+			t.Errorf("unexpected method %s", r.Method)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	reg := &Registry{
+		URL:    ts.URL,
+		Client: ts.Client(),
+		Logf:   func(string, ...interface{}) {},
+	}
+	getBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+
+	err := reg.UploadBlobChunked("test-repo", "sha256:deadbeef", bytes.NewReader(content), chunkSize, WithChunkedGetBody(getBody))
+	if err != nil {
+		t.Fatalf("UploadBlobChunked: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if patchCalls != 3 {
+		t.Fatalf("got %d PATCH calls, want 3", patchCalls)
+	}
+}
@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/docker/distribution"
+)
+
+// BlobSource supplies the content for a layer that PushImage could not
+// mount from sourceRepo and must therefore upload in full.
+type BlobSource func(distribution.Descriptor) (content io.Reader, getBody func() (io.ReadCloser, error), err error)
+
+// PushImage pushes the blobs referenced by manifest into repository. For
+// each blob in manifest.References() (the layers, and the config blob where
+// the manifest has one) it first tries to cross-mount the blob from
+// sourceRepo (see MountBlob) to avoid re-uploading bytes the registry
+// already has under a different name; any blob the registry declines to mount is uploaded in
+// full using content from source. PushImage only pushes blobs — callers
+// remain responsible for PUTing the manifest itself once all of its layers
+// exist in repository.
+func (registry *Registry) PushImage(repository, sourceRepo string, manifest distribution.Manifest, source BlobSource) error {
+	for _, d := range manifest.References() {
+		mounted, uploadUrl, err := registry.MountBlob(repository, sourceRepo, d.Digest)
+		if err != nil {
+			return fmt.Errorf("error while pushing image to %s, digest: %s: %s", repository, d.Digest, err)
+		}
+		if mounted {
+			registry.Logf("registry.push.mounted repository=%s sourceRepo=%s digest=%s", repository, sourceRepo, d.Digest)
+			continue
+		}
+
+		content, getBody, err := source(d)
+		if err != nil {
+			return fmt.Errorf("error while pushing image to %s, digest: %s: %s", repository, d.Digest, err)
+		}
+
+		if uploadUrl != nil {
+			if err := registry.uploadToUrl(uploadUrl, d.Digest, content, getBody); err != nil {
+				return fmt.Errorf("error while pushing image to %s, digest: %s: %s", repository, d.Digest, err)
+			}
+			continue
+		}
+		if err := registry.UploadBlob(repository, d.Digest, content, getBody); err != nil {
+			return fmt.Errorf("error while pushing image to %s, digest: %s: %s", repository, d.Digest, err)
+		}
+	}
+	return nil
+}